@@ -0,0 +1,458 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package badgerdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/dgraph-io/badger"
+	"github.com/ortuman/jackal/log"
+)
+
+// backupWatermarkKey persists the badger version watermark reached by the
+// last backup, so a process restart resumes incremental backups from
+// where it left off instead of silently falling back to a full backup.
+var backupWatermarkKey = []byte("backupScheduler:watermark")
+
+// loadBackupWatermark reads the watermark persisted by the previous
+// process, returning 0 if none was ever written (first backup ever, or
+// a database predating this persistence).
+func loadBackupWatermark(db *badger.DB) (uint64, error) {
+	var watermark uint64
+	err := db.View(func(tx *badger.Txn) error {
+		item, err := tx.Get(backupWatermarkKey)
+		switch err {
+		case nil:
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		watermark = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return watermark, err
+}
+
+// saveBackupWatermark persists watermark so the next process restart
+// resumes incremental backups from it.
+func saveBackupWatermark(db *badger.DB, watermark uint64) error {
+	return db.Update(func(tx *badger.Txn) error {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], watermark)
+		return tx.Set(backupWatermarkKey, buf[:])
+	})
+}
+
+// BackupConfig configures the scheduled full+incremental backup
+// sub system built on top of badger's stream backup.
+type BackupConfig struct {
+	// Interval between scheduled backups. A zero value disables the
+	// background scheduler; Storage.Backup/Restore remain usable on
+	// demand regardless.
+	Interval time.Duration `yaml:"interval"`
+
+	// Retention is the number of backup generations (a full backup plus
+	// the incrementals chained after it) kept on disk; older generations
+	// are pruned after every successful backup. A full backup is taken
+	// only while the recorded watermark is zero; every later run is an
+	// incremental of the same generation, so no new generation starts
+	// and nothing is pruned while that generation is the only one.
+	Retention int `yaml:"retention"`
+
+	// Destination is the local directory backup files are written to.
+	Destination string `yaml:"destination"`
+
+	// EncryptionKey, if set, is a hex-encoded 32-byte key used to
+	// encrypt every backup file with chacha20poly1305.
+	EncryptionKey string `yaml:"encryption_key"`
+}
+
+// backupFilePrefix names every file written under Destination so pruning
+// and replay can tell backups apart from unrelated files.
+const backupFilePrefix = "jackal-backup-"
+
+// Backup streams every entry with a version greater than since to w,
+// leveraging badger's native stream backup, and returns the badger
+// version watermark reached so the next incremental can resume from it.
+func (b *Storage) Backup(w io.Writer, since uint64) (uint64, error) {
+	return b.db.Backup(w, since)
+}
+
+// Restore replays a stream previously produced by Backup, restoring the
+// database to the point-in-time it was taken at. Multiple incremental
+// streams must be replayed in the same order they were recorded in.
+func (b *Storage) Restore(r io.Reader) error {
+	return b.db.Load(r)
+}
+
+// backupScheduler drives the periodic full+incremental backup described
+// by BackupConfig, keeping track of the badger version watermark reached
+// by the last backup so the next tick can take an incremental one.
+// watermark is persisted under backupWatermarkKey and reloaded in
+// newBackupScheduler, so a process restart resumes incremental backups
+// instead of falling back to a full one every time.
+//
+// mu serializes run() so a scheduled tick and an admin-triggered
+// TriggerBackup call can never race over watermark or produce
+// overlapping backup files.
+type backupScheduler struct {
+	storage   *Storage
+	cfg       BackupConfig
+	aead      cipher
+	mu        sync.Mutex
+	watermark uint64
+	doneCh    chan chan bool
+}
+
+// cipher is satisfied by the AEAD construction used to encrypt backups.
+type cipher interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	NonceSize() int
+}
+
+// newBackupScheduler builds a scheduler for cfg, or nil if neither
+// scheduled nor on-demand backups are configured. The scheduler is still
+// built (without starting its ticker) when only Destination is set, so
+// TriggerBackup works even with Interval left at zero.
+func newBackupScheduler(storage *Storage, cfg BackupConfig) (*backupScheduler, error) {
+	if len(cfg.Destination) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Destination, 0750); err != nil {
+		return nil, err
+	}
+	var aead cipher
+	if len(cfg.EncryptionKey) > 0 {
+		key, err := hex.DecodeString(cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("badgerdb: invalid backup encryption key: %v", err)
+		}
+		aead, err = chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	watermark, err := loadBackupWatermark(storage.db)
+	if err != nil {
+		return nil, err
+	}
+	return &backupScheduler{
+		storage:   storage,
+		cfg:       cfg,
+		aead:      aead,
+		watermark: watermark,
+		doneCh:    make(chan chan bool),
+	}, nil
+}
+
+// loop drives the periodic ticker when Interval is set; with Interval
+// left at zero it simply waits for shutdown, leaving TriggerBackup as
+// the only way to take a backup.
+func (s *backupScheduler) loop() {
+	var tickCh <-chan time.Time
+	if s.cfg.Interval > 0 {
+		tc := time.NewTicker(s.cfg.Interval)
+		defer tc.Stop()
+		tickCh = tc.C
+	}
+	for {
+		select {
+		case <-tickCh:
+			if _, err := s.run(); err != nil {
+				log.Errorf("%v", err)
+			}
+		case ch := <-s.doneCh:
+			close(ch)
+			return
+		}
+	}
+}
+
+// run takes a backup (full the first time, incremental afterwards),
+// writes it to Destination and prunes generations beyond Retention. It
+// holds mu for its whole duration so a scheduled tick and an
+// admin-triggered TriggerBackup call can never race over watermark.
+func (s *backupScheduler) run() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	startWatermark := s.watermark
+	path := filepath.Join(s.cfg.Destination, fmt.Sprintf("%s%d-%d.bak", backupFilePrefix, time.Now().UTC().UnixNano(), startWatermark))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if s.aead != nil {
+		w = newEncryptingWriter(f, s.aead)
+	}
+	newWatermark, err := s.storage.Backup(w, startWatermark)
+	if err != nil {
+		return "", err
+	}
+	if err := saveBackupWatermark(s.storage.db, newWatermark); err != nil {
+		return "", err
+	}
+	s.watermark = newWatermark
+
+	if s.cfg.Retention > 0 {
+		if err := s.prune(); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	return path, nil
+}
+
+// prune keeps the last Retention backup generations, where a generation
+// is a full backup (starting watermark 0) together with every
+// incremental chained after it. It never removes a full backup while a
+// newer incremental still depends on it being replayed first.
+func (s *backupScheduler) prune() error {
+	entries, err := ioutil.ReadDir(s.cfg.Destination)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupFilePrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	// Locate the start of each generation: a file whose encoded
+	// starting watermark is zero begins a new full backup.
+	var genStarts []int
+	for i, name := range names {
+		if backupStartWatermark(name) == 0 {
+			genStarts = append(genStarts, i)
+		}
+	}
+	if len(genStarts) <= s.cfg.Retention {
+		return nil
+	}
+	// Drop every file belonging to the oldest generations, keeping only
+	// the last Retention of them.
+	cut := genStarts[len(genStarts)-s.cfg.Retention]
+	for _, name := range names[:cut] {
+		if err := os.Remove(filepath.Join(s.cfg.Destination, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupStartWatermark extracts the starting watermark encoded in a
+// backup file name written by run(), or -1 if name doesn't match the
+// expected format.
+func backupStartWatermark(name string) int64 {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), ".bak")
+	parts := strings.Split(trimmed, "-")
+	if len(parts) != 2 {
+		return -1
+	}
+	wm, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return wm
+}
+
+func (s *backupScheduler) shutdown() {
+	ch := make(chan bool)
+	s.doneCh <- ch
+	<-ch
+}
+
+// newEncryptingWriter wraps w so every Write call is sealed as its own
+// AEAD message under a fresh random nonce, length-prefixed so Restore
+// can split the stream back into the original chunks. A random nonce
+// per record — rather than a counter reset on every run — means two
+// independently started backups (a scheduled tick racing an admin
+// TriggerBackup, or two successive runs) never reuse a nonce under the
+// same key.
+func newEncryptingWriter(w io.Writer, aead cipher) io.Writer {
+	return &encryptingWriter{w: w, aead: aead}
+}
+
+type encryptingWriter struct {
+	w    io.Writer
+	aead cipher
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	sealed := e.aead.Seal(nil, nonce, p, nil)
+
+	record := append(nonce, sealed...)
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(len(record)))
+	if _, err := e.w.Write(lenBuf[:]); err != nil {
+		return 0, err
+	}
+	if _, err := e.w.Write(record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decryptingReader is the Read-side counterpart of encryptingWriter.
+type decryptingReader struct {
+	r    io.Reader
+	aead cipher
+	buf  []byte
+}
+
+func newDecryptingReader(r io.Reader, aead cipher) io.Reader {
+	return &decryptingReader{r: r, aead: aead}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if len(d.buf) == 0 {
+		var lenBuf [8]byte
+		if _, err := io.ReadFull(d.r, lenBuf[:]); err != nil {
+			return 0, err
+		}
+		record := make([]byte, binary.BigEndian.Uint64(lenBuf[:]))
+		if _, err := io.ReadFull(d.r, record); err != nil {
+			return 0, err
+		}
+		nonceSize := d.aead.NonceSize()
+		if len(record) < nonceSize {
+			return 0, fmt.Errorf("badgerdb: truncated backup record")
+		}
+		nonce, sealed := record[:nonceSize], record[nonceSize:]
+
+		plain, err := d.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return 0, err
+		}
+		d.buf = plain
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// TriggerBackup takes an immediate, ad-hoc backup through the same run()
+// as the scheduler (full while no watermark is recorded, incremental
+// from the recorded watermark otherwise) and returns the path of the
+// resulting file.
+//
+// Known gap: the request this implements asks for an admin ad-hoc
+// command over XMPP to trigger a snapshot on demand, but this tree has
+// no XEP-0050 ad-hoc command dispatcher or component/IQ routing layer
+// at all to host one. TriggerBackup is exported and otherwise complete
+// so that such a handler has exactly one storage-layer call to make once
+// that subsystem exists, but as delivered here it has no caller —
+// operators can only reach it by importing this package directly, not
+// over the wire.
+func (b *Storage) TriggerBackup() (string, error) {
+	if b.backup == nil {
+		return "", fmt.Errorf("badgerdb: scheduled backup is not configured")
+	}
+	return b.backup.run()
+}
+
+// restoreEncrypted decrypts and restores a backup stream previously
+// produced with an EncryptionKey configured.
+func (b *Storage) restoreEncrypted(r io.Reader, hexKey string) error {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return err
+	}
+	return b.Restore(newDecryptingReader(r, aead))
+}
+
+// RestorePointInTime replays backup files under dir, in the order they
+// were produced (oldest full backup first, followed by its
+// incrementals), reconstructing the database as it stood at a specific
+// point in time: the most recent file whose name encodes a timestamp no
+// later than until, or every file if until is the zero Time. A zero
+// until reconstructs the database as it stood at the time of the most
+// recent backup, matching the previous, restore-everything-available
+// behavior. encryptionKey must match whatever key the files were written
+// with, or be empty if they were not encrypted.
+func (b *Storage) RestorePointInTime(dir string, until time.Time, encryptionKey string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupFilePrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !until.IsZero() {
+			if ts, ok := backupTimestamp(name); ok && ts.After(until) {
+				break
+			}
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if len(encryptionKey) > 0 {
+			err = b.restoreEncrypted(f, encryptionKey)
+		} else {
+			err = b.Restore(f)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("badgerdb: failed to restore %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// backupTimestamp extracts the creation time encoded in a backup file
+// name written by run(), or false if name doesn't match the expected
+// format.
+func backupTimestamp(name string) (time.Time, bool) {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(name, backupFilePrefix), ".bak")
+	parts := strings.Split(trimmed, "-")
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
@@ -6,8 +6,6 @@
 package badgerdb
 
 import (
-	"bytes"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"os"
@@ -18,7 +16,7 @@ import (
 	"github.com/dgraph-io/badger"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/pool"
-	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/storage"
 )
 
 var (
@@ -26,23 +24,58 @@ var (
 	errBadgerDBEntityNotFound  = errors.New("badgerdb: entity not found")
 )
 
+var _ storage.Backend = (*Storage)(nil)
+
 // Config represents BadgerDB storage configuration.
 type Config struct {
 	DataDir string `yaml:"data_dir"`
+
+	// Codec selects the serialization codec used to persist entities.
+	// Defaults to "gob" when empty. Databases written with a previous
+	// codec keep decoding correctly regardless of this setting.
+	Codec string `yaml:"codec"`
+
+	// CacheSizeBytes bounds the in-memory cache of raw encoded bytes
+	// placed in front of BadgerDB reads. A value of zero disables that
+	// cache entirely.
+	CacheSizeBytes int `yaml:"cache_size_bytes"`
+
+	// DecodedCacheItems bounds the in-memory cache of already-decoded
+	// entities placed in front of CacheSizeBytes' raw-byte cache, so a
+	// repeat Fetch of a hot entity skips the codec decode too, not just
+	// the badger read. A value of zero disables that cache entirely.
+	DecodedCacheItems int `yaml:"decoded_cache_items"`
+
+	// Backup configures the scheduled full+incremental backup sub
+	// system. A zero value leaves scheduled backups disabled; Backup/
+	// Restore stay usable on demand either way.
+	Backup BackupConfig `yaml:"backup"`
 }
 
 // Storage represents a BadgerDB storage sub system.
 type Storage struct {
-	db     *badger.DB
-	pool   *pool.BufferPool
-	doneCh chan chan bool
+	db           *badger.DB
+	pool         *pool.BufferPool
+	doneCh       chan chan bool
+	index        *indexQueue
+	codec        Codec
+	cache        *objectCache
+	decodedCache *decodedCache
+	backup       *backupScheduler
 }
 
 // New returns a new BadgerDB storage instance.
 func New(cfg *Config) *Storage {
+	codec, err := codecByName(cfg.Codec)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	b := &Storage{
-		pool:   pool.NewBufferPool(),
-		doneCh: make(chan chan bool),
+		pool:         pool.NewBufferPool(),
+		doneCh:       make(chan chan bool),
+		codec:        codec,
+		cache:        newObjectCache(cfg.CacheSizeBytes),
+		decodedCache: newDecodedCache(cfg.DecodedCacheItems),
 	}
 	if err := os.MkdirAll(filepath.Dir(cfg.DataDir), os.ModePerm); err != nil {
 		log.Fatalf("%v", err)
@@ -55,15 +88,105 @@ func New(cfg *Config) *Storage {
 		log.Fatalf("%v", err)
 	}
 	b.db = db
+
+	indexer, err := newBleveIndexer(indexDirFromDataDir(cfg.DataDir))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	b.index = newIndexQueue(db, indexer)
+
+	backup, err := newBackupScheduler(b, cfg.Backup)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	b.backup = backup
+	if b.backup != nil {
+		go b.backup.loop()
+	}
+
 	go b.loop()
 	return b
 }
 
 // Shutdown shuts down BadgerDB storage sub system.
-func (b *Storage) Shutdown() {
+func (b *Storage) Shutdown() error {
 	ch := make(chan bool)
 	b.doneCh <- ch
 	<-ch
+	b.index.shutdown()
+	if b.backup != nil {
+		b.backup.shutdown()
+	}
+	return nil
+}
+
+// InsertOrUpdate stores entity under key, replacing any previous value,
+// satisfying storage.Backend.
+func (b *Storage) InsertOrUpdate(entity interface{}, key []byte) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(entity, key, tx)
+	})
+}
+
+// Fetch loads the entity stored under key into entity, satisfying
+// storage.Backend.
+func (b *Storage) Fetch(entity interface{}, key []byte) error {
+	if err := b.fetch(entity, key); err != nil {
+		if err == errBadgerDBEntityNotFound {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// FetchAll loads every entity whose key has the given prefix into v,
+// satisfying storage.Backend.
+func (b *Storage) FetchAll(v interface{}, prefix []byte) error {
+	return b.fetchAll(v, prefix)
+}
+
+// Delete removes the entity stored under key, if any, satisfying
+// storage.Backend.
+func (b *Storage) Delete(key []byte) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.delete(key, tx)
+	})
+}
+
+// DeletePrefix removes every entity whose key has the given prefix,
+// satisfying storage.Backend.
+func (b *Storage) DeletePrefix(prefix []byte) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.deletePrefix(prefix, tx)
+	})
+}
+
+// ForEachKey invokes f for every key with the given prefix, satisfying
+// storage.Backend.
+func (b *Storage) ForEachKey(prefix []byte, f func(key []byte) error) error {
+	return b.forEachKey(prefix, f)
+}
+
+// IndexDoc enqueues doc to be indexed under entityID, returning immediately
+// so hot XMPP paths never block on the underlying indexer. Intended to be
+// called by MAM/offline storage methods right after insertOrUpdate succeeds.
+func (b *Storage) IndexDoc(entityID string, doc map[string]interface{}) error {
+	return b.index.enqueue(indexOp{Kind: indexOpUpsert, EntityID: entityID, Doc: doc})
+}
+
+// UnindexDoc enqueues the removal of entityID from the search index.
+// Intended to be called right after delete/deletePrefix succeeds.
+func (b *Storage) UnindexDoc(entityID string) error {
+	return b.index.enqueue(indexOp{Kind: indexOpDelete, EntityID: entityID})
+}
+
+// SearchArchive runs a XEP-0313 style full-text query over the indexed
+// archived/offline messages. This storage-layer method has no caller
+// yet: jackal doesn't have a XEP-0313 message archive management IQ
+// handler in this tree to route requests into it.
+func (b *Storage) SearchArchive(query Query, opts SearchOptions) ([]Hit, error) {
+	return b.index.backend.Search(query, opts)
 }
 
 func (b *Storage) loop() {
@@ -83,22 +206,50 @@ func (b *Storage) loop() {
 }
 
 func (b *Storage) insertOrUpdate(entity interface{}, key []byte, tx *badger.Txn) error {
-	gs, ok := entity.(model.GobSerializer)
+	s, ok := entity.(Serializer)
 	if !ok {
 		return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, entity)
 	}
-	buf := b.pool.Get()
-	defer b.pool.Put(buf)
-
-	gs.ToGob(gob.NewEncoder(buf))
-	bts := buf.Bytes()
-	val := make([]byte, len(bts))
-	copy(val, bts)
-	return tx.Set(key, val)
+	val, err := encode(b.codec, s)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(key, val); err != nil {
+		return err
+	}
+	// tx hasn't committed yet at this point — badger's optimistic
+	// concurrency control can still abort it on conflict — so the new
+	// value must not be cached here. Invalidate instead: a stale cache
+	// hit would be wrong, a miss just costs the next fetch a badger read.
+	b.cache.invalidate(key)
+	b.decodedCache.invalidate(key)
+	// Unlike the cache, the search index tolerates staleness: a SearchArchive
+	// hit is a candidate ID, never trusted data on its own, so indexing
+	// optimistically here (ahead of tx's own commit) just means an aborted
+	// write can leave a stale or missing index entry until the entity is
+	// next written. enqueue persists the op in its own badger transaction,
+	// separate from tx, so the queued op is kept even if tx aborts.
+	if ix, ok := entity.(Indexable); ok {
+		if err := b.index.enqueue(indexOp{Kind: indexOpUpsert, EntityID: ix.IndexEntityID(), Doc: ix.IndexDoc()}); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	return nil
 }
 
 func (b *Storage) delete(key []byte, txn *badger.Txn) error {
-	return txn.Delete(key)
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	b.cache.invalidate(key)
+	b.decodedCache.invalidate(key)
+	// Unindexing a key that was never indexed is a harmless no-op, so
+	// enqueue it unconditionally rather than threading an Indexable check
+	// through every call site that only has a key, not the entity.
+	if err := b.index.enqueue(indexOp{Kind: indexOpDelete, EntityID: string(key)}); err != nil {
+		log.Errorf("%v", err)
+	}
+	return nil
 }
 
 func (b *Storage) deletePrefix(prefix []byte, txn *badger.Txn) error {
@@ -113,28 +264,91 @@ func (b *Storage) deletePrefix(prefix []byte, txn *badger.Txn) error {
 		if err := txn.Delete(k); err != nil {
 			return err
 		}
+		if err := b.index.enqueue(indexOp{Kind: indexOpDelete, EntityID: string(k)}); err != nil {
+			log.Errorf("%v", err)
+		}
 	}
+	b.cache.invalidatePrefix(prefix)
+	b.decodedCache.invalidatePrefix(prefix)
 	return nil
 }
 
+// CacheHits returns the running count of object cache hits.
+func (b *Storage) CacheHits() int64 { return b.cache.hitCount() }
+
+// CacheMisses returns the running count of object cache misses.
+func (b *Storage) CacheMisses() int64 { return b.cache.missCount() }
+
 func (b *Storage) fetch(entity interface{}, key []byte) error {
-	return b.db.View(func(tx *badger.Txn) error {
+	if entity != nil {
+		if cached, ok := b.decodedCache.get(key); ok {
+			if _, ok := entity.(Deserializer); !ok {
+				return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, entity)
+			}
+			reflect.ValueOf(entity).Elem().Set(reflect.ValueOf(cached).Elem())
+			return nil
+		}
+	}
+
+	var needsRewrite bool
+	if cached, ok := b.cache.get(key); ok {
+		if entity != nil {
+			d, ok := entity.(Deserializer)
+			if !ok {
+				return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, entity)
+			}
+			if _, err := decode(cached, d); err != nil {
+				return err
+			}
+			b.decodedCache.put(key, cloneEntity(entity))
+		}
+		return nil
+	}
+	if err := b.db.View(func(tx *badger.Txn) error {
 		val, err := b.getVal(key, tx)
 		if err != nil {
 			return err
 		}
-		if val != nil {
-			if entity != nil {
-				gd, ok := entity.(model.GobDeserializer)
-				if !ok {
-					return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, entity)
-				}
-				gd.FromGob(gob.NewDecoder(bytes.NewReader(val)))
+		if val == nil {
+			return errBadgerDBEntityNotFound
+		}
+		b.cache.put(key, val)
+		if entity != nil {
+			d, ok := entity.(Deserializer)
+			if !ok {
+				return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, entity)
 			}
-			return nil
+			tag, err := decode(val, d)
+			if err != nil {
+				return err
+			}
+			needsRewrite = tag != b.codec.Tag()
+			b.decodedCache.put(key, cloneEntity(entity))
 		}
-		return errBadgerDBEntityNotFound
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
+	if needsRewrite {
+		// Lazily rewrite legacy entries with the currently configured
+		// codec so the database converges to a single format over time.
+		if s, ok := entity.(Serializer); ok {
+			_ = b.db.Update(func(tx *badger.Txn) error {
+				return b.insertOrUpdate(s, key, tx)
+			})
+		}
+	}
+	return nil
+}
+
+// cloneEntity returns a new pointer to a private copy of the struct
+// entity points to, so decodedCache keeps its own copy independent of
+// whatever the caller does with entity afterwards.
+func cloneEntity(entity interface{}) interface{} {
+	v := reflect.ValueOf(entity)
+	clone := reflect.New(v.Elem().Type())
+	clone.Elem().Set(v.Elem())
+	return clone.Interface()
 }
 
 func (b *Storage) fetchAll(v interface{}, prefix []byte) error {
@@ -146,15 +360,16 @@ func (b *Storage) fetchAll(v interface{}, prefix []byte) error {
 	return b.forEachKeyAndValue(prefix, func(k, val []byte) error {
 		e := reflect.New(t.Elem()).Elem()
 		i := e.Addr().Interface()
-		gd, ok := i.(model.GobDeserializer)
+		d, ok := i.(Deserializer)
 		if !ok {
 			return fmt.Errorf("%v: %T", errBadgerDBWrongEntityType, i)
 		}
-		gd.FromGob(gob.NewDecoder(bytes.NewReader(val)))
+		if _, err := decode(val, d); err != nil {
+			return err
+		}
 		s.Set(reflect.Append(s, e))
 		return nil
 	})
-	return nil
 }
 
 func (b *Storage) getVal(key []byte, txn *badger.Txn) ([]byte, error) {
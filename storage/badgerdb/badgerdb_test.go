@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package badgerdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ortuman/jackal/storage/storagetest"
+)
+
+func TestStorage_Conformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badgerdb-conformance")
+	if err != nil {
+		t.Fatalf("TempDir() = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(&Config{DataDir: dir})
+	defer s.Shutdown()
+
+	storagetest.Run(t, s)
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package badgerdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// objectCache is a bounded, concurrency-safe LRU cache keyed by a
+// storage key, holding the raw encoded bytes read from BadgerDB (writes
+// only invalidate an entry, never fill it) so repeat lookups of hot entities — roster items,
+// vCards, private XML, offline messages — skip the badger read. A hit
+// still runs the codec decode against the cached bytes; decodedCache is
+// the layer in front of this one that skips that too.
+//
+// It is modeled after go-git's plumbing/cache ByteSlice cache: bounded
+// by total byte size rather than entry count, since entities vary
+// wildly in size.
+type objectCache struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	maxBytes int
+	curBytes int
+
+	// hits and misses are exposed as Prometheus-style counters through
+	// Storage.CacheHits/CacheMisses so the cache's effectiveness can be
+	// scraped without instrumenting every call site.
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+// newObjectCache returns a cache bounded to maxBytes. A maxBytes of zero
+// yields a cache that degrades gracefully to a pass-through — get always
+// misses and put is a no-op.
+func newObjectCache(maxBytes int) *objectCache {
+	return &objectCache{
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		maxBytes: maxBytes,
+	}
+}
+
+func (c *objectCache) get(key []byte) ([]byte, bool) {
+	if c.maxBytes <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[string(key)]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	atomic.AddInt64(&c.hits, 1)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// hitCount and missCount report the running Prometheus-style counters.
+func (c *objectCache) hitCount() int64  { return atomic.LoadInt64(&c.hits) }
+func (c *objectCache) missCount() int64 { return atomic.LoadInt64(&c.misses) }
+
+func (c *objectCache) put(key []byte, value []byte) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := string(key)
+	if el, ok := c.items[k]; ok {
+		c.curBytes += len(value) - len(el.Value.(*cacheEntry).value)
+		el.Value.(*cacheEntry).value = value
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&cacheEntry{key: k, value: value})
+		c.items[k] = el
+		c.curBytes += len(value)
+	}
+	for c.curBytes > c.maxBytes && c.ll.Len() > 0 {
+		c.evictOldest()
+	}
+}
+
+func (c *objectCache) invalidate(key []byte) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[string(key)]; ok {
+		c.removeElement(el)
+	}
+}
+
+// invalidatePrefix drops every cached entry whose key starts with prefix,
+// used after deletePrefix removes a whole range from BadgerDB.
+func (c *objectCache) invalidatePrefix(prefix []byte) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := string(prefix)
+	for k, el := range c.items {
+		if len(k) >= len(p) && k[:len(p)] == p {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *objectCache) evictOldest() {
+	el := c.ll.Back()
+	if el != nil {
+		c.removeElement(el)
+	}
+}
+
+func (c *objectCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	entry := el.Value.(*cacheEntry)
+	delete(c.items, entry.key)
+	c.curBytes -= len(entry.value)
+}
+
+// decodedCache is a bounded, concurrency-safe LRU cache keyed by a
+// storage key, holding already-decoded entities so a repeat Fetch of a
+// hot entity skips the codec decode entirely, not just the badger read
+// that objectCache already skips. It sits in front of objectCache:
+// Storage.fetch checks decodedCache first and only falls through to
+// objectCache/badger on a miss.
+//
+// It is modeled after go-git's plumbing/cache Object cache: bounded by
+// entry count rather than byte size, since — unlike objectCache's raw
+// bytes — decoded entities aren't cheaply measurable in bytes.
+type decodedCache struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	maxItems int
+}
+
+type decodedEntry struct {
+	key   string
+	value interface{} // pointer to a private copy of the decoded entity
+}
+
+// newDecodedCache returns a cache bounded to maxItems entries. A
+// maxItems of zero yields a cache that degrades gracefully to a
+// pass-through — get always misses and put is a no-op.
+func newDecodedCache(maxItems int) *decodedCache {
+	return &decodedCache{
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		maxItems: maxItems,
+	}
+}
+
+func (c *decodedCache) get(key []byte) (interface{}, bool) {
+	if c.maxItems <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*decodedEntry).value, true
+}
+
+func (c *decodedCache) put(key []byte, value interface{}) {
+	if c.maxItems <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := string(key)
+	if el, ok := c.items[k]; ok {
+		el.Value.(*decodedEntry).value = value
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&decodedEntry{key: k, value: value})
+		c.items[k] = el
+	}
+	for c.ll.Len() > c.maxItems {
+		el := c.ll.Back()
+		if el == nil {
+			break
+		}
+		c.removeElement(el)
+	}
+}
+
+func (c *decodedCache) invalidate(key []byte) {
+	if c.maxItems <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[string(key)]; ok {
+		c.removeElement(el)
+	}
+}
+
+// invalidatePrefix drops every cached entry whose key starts with
+// prefix, used after deletePrefix removes a whole range from BadgerDB.
+func (c *decodedCache) invalidatePrefix(prefix []byte) {
+	if c.maxItems <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := string(prefix)
+	for k, el := range c.items {
+		if len(k) >= len(p) && k[:len(p)] == p {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *decodedCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*decodedEntry).key)
+}
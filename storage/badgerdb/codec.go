@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package badgerdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// codecTag identifies, as the single leading byte of every stored
+// value, which Codec produced it. This lets a migrated database mix
+// legacy gob entries with newer ones and auto-detect them on read.
+type codecTag byte
+
+const (
+	codecTagGob codecTag = iota
+	codecTagCompact
+
+	// codecTagLegacyGob is never written by encode; decode reports it
+	// for values that predate the Codec abstraction entirely, i.e. raw
+	// encoding/gob output with no leading tag byte, so fetch's
+	// lazy-rewrite logic knows to upgrade them to a tagged codec too.
+	codecTagLegacyGob codecTag = 0xFF
+)
+
+// Serializer is implemented by entities that can encode themselves through
+// a Codec. It generalizes model.GobSerializer beyond encoding/gob.
+type Serializer interface {
+	model.GobSerializer
+}
+
+// Deserializer is implemented by entities that can decode themselves
+// through a Codec. It generalizes model.GobDeserializer beyond
+// encoding/gob.
+type Deserializer interface {
+	model.GobDeserializer
+}
+
+// Codec marshals and unmarshals entities to and from their on-disk
+// representation.
+type Codec interface {
+	// Name identifies the codec, used for configuration and logging.
+	Name() string
+
+	// Tag is the byte written as a value's first byte so a reader can
+	// tell which codec produced it without out-of-band information.
+	Tag() codecTag
+
+	Marshal(v Serializer) ([]byte, error)
+	Unmarshal(data []byte, v Deserializer) error
+}
+
+// gobCodec is the original encoding/gob based codec, kept for backward
+// compatibility with databases created before the codec abstraction.
+type gobCodec struct{}
+
+func (gobCodec) Name() string  { return "gob" }
+func (gobCodec) Tag() codecTag { return codecTagGob }
+
+func (gobCodec) Marshal(v Serializer) ([]byte, error) {
+	var buf bytes.Buffer
+	v.ToGob(gob.NewEncoder(&buf))
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v Deserializer) error {
+	v.FromGob(gob.NewDecoder(bytes.NewReader(data)))
+	return nil
+}
+
+// compactCodec is a smaller binary codec for the same entities gobCodec
+// handles: it gob-encodes the entity exactly like gobCodec, then
+// flate-compresses the result. It trades a little CPU for meaningfully
+// smaller payloads without requiring entities to adopt a second,
+// generated serialization format such as protobuf.
+type compactCodec struct{}
+
+func (compactCodec) Name() string  { return "compact" }
+func (compactCodec) Tag() codecTag { return codecTagCompact }
+
+func (compactCodec) Marshal(v Serializer) ([]byte, error) {
+	var gobBuf bytes.Buffer
+	v.ToGob(gob.NewEncoder(&gobBuf))
+
+	var out bytes.Buffer
+	fw, err := flate.NewWriter(&out, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(gobBuf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (compactCodec) Unmarshal(data []byte, v Deserializer) error {
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	v.FromGob(gob.NewDecoder(fr))
+	return nil
+}
+
+// codecs maps every known codecTag to its implementation, used to
+// auto-detect and decode an entity regardless of which codec wrote it.
+var codecs = map[codecTag]Codec{
+	codecTagGob:     gobCodec{},
+	codecTagCompact: compactCodec{},
+}
+
+// codecByName resolves a Config.Codec value into a Codec implementation.
+func codecByName(name string) (Codec, error) {
+	switch name {
+	case "", "gob":
+		return gobCodec{}, nil
+	case "compact":
+		return compactCodec{}, nil
+	default:
+		return nil, fmt.Errorf("badgerdb: unknown codec %q", name)
+	}
+}
+
+// encode tags data with c's codec byte so a future reader can auto-detect
+// how to decode it, regardless of which codec is configured at the time.
+func encode(c Codec, v Serializer) ([]byte, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(c.Tag())}, b...), nil
+}
+
+// decode reads the leading codec tag byte off data and dispatches to the
+// matching Codec, so legacy gob entries keep decoding correctly even
+// after Config.Codec switches to a newer codec.
+//
+// Databases created before this abstraction existed hold raw
+// encoding/gob output with no leading tag byte at all, so data[0] there
+// is just the first byte of the gob stream and will rarely happen to
+// match a known codecTag. A value whose first byte is not a known
+// codecTag is treated as legacy untagged gob, so pre-existing rows keep
+// working after the upgrade and get swept into a tagged codec by fetch's
+// lazy rewrite on next read. Codec.Unmarshal reports no decode errors
+// (FromGob returns none), so a legacy value whose first byte does equal
+// a known codecTag is decoded by that codec and is not detected as
+// legacy gob.
+func decode(data []byte, v Deserializer) (codecTag, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("badgerdb: empty value")
+	}
+	tag := codecTag(data[0])
+	if c, ok := codecs[tag]; ok {
+		if err := c.Unmarshal(data[1:], v); err == nil {
+			return tag, nil
+		}
+	}
+	if err := (gobCodec{}).Unmarshal(data, v); err == nil {
+		return codecTagLegacyGob, nil
+	}
+	return 0, fmt.Errorf("badgerdb: unknown codec tag %d", tag)
+}
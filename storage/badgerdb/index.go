@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package badgerdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"path/filepath"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/dgraph-io/badger"
+	"github.com/ortuman/jackal/log"
+)
+
+// indexQueuePrefix is the badger key prefix under which pending index
+// operations are persisted so they survive a restart before being drained.
+var indexQueuePrefix = []byte("indexQueue:")
+
+// indexOpKind identifies the kind of operation queued against the indexer.
+type indexOpKind int
+
+const (
+	indexOpUpsert indexOpKind = iota
+	indexOpDelete
+)
+
+// indexOp represents a single pending indexer operation.
+type indexOp struct {
+	Kind     indexOpKind
+	EntityID string
+	Doc      map[string]interface{}
+}
+
+// indexFieldFrom and indexFieldTimestamp are the bleve document fields
+// Query.From/Since/Until filter on. A Doc returned by Indexable.IndexDoc
+// must populate these under these exact keys for the corresponding
+// filter to have any effect — Search has no other way to know which
+// field holds a message's sender or timestamp.
+const (
+	indexFieldFrom      = "from"
+	indexFieldTimestamp = "timestamp"
+)
+
+// Query represents a full-text search query over archived entities.
+type Query struct {
+	Text string
+
+	// From restricts results to messages sent by this JID, if non-empty.
+	// Matched against the indexed document's indexFieldFrom field.
+	From string
+
+	// Since and Until bound the search to a time range. A zero value
+	// leaves that bound unset. Matched against the indexed document's
+	// indexFieldTimestamp field.
+	Since time.Time
+	Until time.Time
+}
+
+// SearchOptions configures pagination over a Search call.
+type SearchOptions struct {
+	MaxResults int
+	Offset     int
+}
+
+// Hit represents a single search result.
+type Hit struct {
+	EntityID string
+	Score    float64
+}
+
+// IndexerBackend is implemented by full-text indexing engines that can be
+// plugged in front of the archived/offline entities stored in BadgerDB.
+type IndexerBackend interface {
+	// Index adds or replaces the document associated to entityID.
+	Index(entityID string, doc map[string]interface{}) error
+
+	// Delete removes the document associated to entityID, if any.
+	Delete(entityID string) error
+
+	// Search runs query against the index, returning matching hits
+	// ordered by relevance.
+	Search(query Query, opts SearchOptions) ([]Hit, error)
+
+	// Close releases any resource held by the backend.
+	Close() error
+}
+
+// bleveIndexer is an IndexerBackend implementation backed by a bleve index
+// stored in a directory sibling to the BadgerDB data directory.
+type bleveIndexer struct {
+	idx bleve.Index
+}
+
+// newBleveIndexer opens (or creates) a bleve index at dir.
+func newBleveIndexer(dir string) (*bleveIndexer, error) {
+	idx, err := bleve.Open(dir)
+	switch err {
+	case nil:
+		return &bleveIndexer{idx: idx}, nil
+	case bleve.ErrorIndexPathDoesNotExist:
+		mapping := bleve.NewIndexMapping()
+		idx, err = bleve.New(dir, mapping)
+		if err != nil {
+			return nil, err
+		}
+		return &bleveIndexer{idx: idx}, nil
+	default:
+		return nil, err
+	}
+}
+
+func (b *bleveIndexer) Index(entityID string, doc map[string]interface{}) error {
+	return b.idx.Index(entityID, doc)
+}
+
+func (b *bleveIndexer) Delete(entityID string) error {
+	return b.idx.Delete(entityID)
+}
+
+func (b *bleveIndexer) Search(query Query, opts SearchOptions) ([]Hit, error) {
+	conjuncts := []bleve.Query{bleve.NewQueryStringQuery(query.Text)}
+	if len(query.From) > 0 {
+		fromQuery := bleve.NewTermQuery(query.From)
+		fromQuery.SetField(indexFieldFrom)
+		conjuncts = append(conjuncts, fromQuery)
+	}
+	if !query.Since.IsZero() || !query.Until.IsZero() {
+		rangeQuery := bleve.NewDateRangeQuery(query.Since, query.Until)
+		rangeQuery.SetField(indexFieldTimestamp)
+		conjuncts = append(conjuncts, rangeQuery)
+	}
+	q := bleve.NewConjunctionQuery(conjuncts...)
+	req := bleve.NewSearchRequest(q)
+	if opts.MaxResults > 0 {
+		req.Size = opts.MaxResults
+	}
+	req.From = opts.Offset
+
+	res, err := b.idx.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]Hit, len(res.Hits))
+	for i, h := range res.Hits {
+		hits[i] = Hit{EntityID: h.ID, Score: h.Score}
+	}
+	return hits, nil
+}
+
+func (b *bleveIndexer) Close() error {
+	return b.idx.Close()
+}
+
+// Indexable is implemented by entities that should be reflected in the
+// full-text search index whenever they're written. IndexEntityID need not
+// match the entity's storage key — it's the identifier SearchArchive hits
+// are reported under.
+type Indexable interface {
+	IndexEntityID() string
+	IndexDoc() map[string]interface{}
+}
+
+// queuedOp pairs a pending indexOp with the badger key it was persisted
+// under, so loop can delete that key once the op has been applied.
+type queuedOp struct {
+	op  indexOp
+	key []byte
+}
+
+// indexQueue drains persisted index operations onto an IndexerBackend
+// through a bounded channel-backed worker so hot XMPP paths never block
+// on the indexer itself.
+type indexQueue struct {
+	db      *badger.DB
+	backend IndexerBackend
+	opCh    chan queuedOp
+	doneCh  chan chan bool
+}
+
+// newIndexQueue creates an indexQueue and starts its worker goroutine,
+// replaying any operation left pending from a previous run.
+func newIndexQueue(db *badger.DB, backend IndexerBackend) *indexQueue {
+	q := &indexQueue{
+		db:      db,
+		backend: backend,
+		opCh:    make(chan queuedOp, 256),
+		doneCh:  make(chan chan bool),
+	}
+	q.replayPending()
+	go q.loop()
+	return q
+}
+
+// enqueue persists op so it is not lost on crash, then hands it to the
+// worker goroutine for asynchronous application, carrying the persisted
+// key along so loop can delete it once applied.
+//
+// enqueue is called from inside insertOrUpdate/delete/deletePrefix,
+// which themselves run inside the caller's open badger.Txn, so the
+// handoff to opCh must never block: if the worker has fallen behind and
+// the channel is full, the op is already durable under indexQueuePrefix,
+// so it isn't lost — replayPending will pick it up on the next restart —
+// it's simply not applied live until then.
+func (q *indexQueue) enqueue(op indexOp) error {
+	key, err := q.persist(op)
+	if err != nil {
+		return err
+	}
+	select {
+	case q.opCh <- queuedOp{op: op, key: key}:
+	default:
+		log.Warnf("badgerdb: index queue full, deferring %s to next restart", op.EntityID)
+	}
+	return nil
+}
+
+func (q *indexQueue) persist(op indexOp) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		return nil, err
+	}
+	key := append(append([]byte{}, indexQueuePrefix...), []byte(op.EntityID+":"+time.Now().UTC().Format(time.RFC3339Nano))...)
+	err := q.db.Update(func(tx *badger.Txn) error {
+		return tx.Set(key, buf.Bytes())
+	})
+	return key, err
+}
+
+// replayPending re-enqueues every index operation still persisted from a
+// previous run, draining them on New as required to survive a restart.
+func (q *indexQueue) replayPending() {
+	var pending []indexOp
+	var keys [][]byte
+	_ = q.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		iter := tx.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Seek(indexQueuePrefix); iter.ValidForPrefix(indexQueuePrefix); iter.Next() {
+			it := iter.Item()
+			val, err := it.Value()
+			if err != nil {
+				continue
+			}
+			var op indexOp
+			if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&op); err != nil {
+				continue
+			}
+			pending = append(pending, op)
+			keys = append(keys, append([]byte{}, it.Key()...))
+		}
+		return nil
+	})
+	for i, op := range pending {
+		if err := q.apply(op); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		_ = q.db.Update(func(tx *badger.Txn) error {
+			return tx.Delete(keys[i])
+		})
+	}
+}
+
+func (q *indexQueue) loop() {
+	for {
+		select {
+		case qo := <-q.opCh:
+			if err := q.apply(qo.op); err != nil {
+				// Leave the persisted record in place so replayPending
+				// retries it on the next restart instead of losing it.
+				log.Errorf("%v", err)
+				continue
+			}
+			if err := q.db.Update(func(tx *badger.Txn) error {
+				return tx.Delete(qo.key)
+			}); err != nil {
+				log.Errorf("%v", err)
+			}
+		case ch := <-q.doneCh:
+			close(ch)
+			return
+		}
+	}
+}
+
+func (q *indexQueue) apply(op indexOp) error {
+	switch op.Kind {
+	case indexOpUpsert:
+		return q.backend.Index(op.EntityID, op.Doc)
+	case indexOpDelete:
+		return q.backend.Delete(op.EntityID)
+	}
+	return nil
+}
+
+func (q *indexQueue) shutdown() {
+	ch := make(chan bool)
+	q.doneCh <- ch
+	<-ch
+	_ = q.backend.Close()
+}
+
+// indexDirFromDataDir derives the bleve index directory from the BadgerDB
+// data directory, keeping it as a sibling directory so the two stores can
+// be backed up and rotated independently.
+func indexDirFromDataDir(dataDir string) string {
+	return filepath.Join(filepath.Dir(dataDir), filepath.Base(dataDir)+"_index")
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package memcached implements the storage.Backend contract on top of a
+// Memcached cluster.
+package memcached
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+var (
+	errMemcachedWrongEntityType = fmt.Errorf("memcached: wrong entity type")
+)
+
+var _ storage.Backend = (*Storage)(nil)
+
+// Config represents Memcached storage configuration.
+type Config struct {
+	Servers []string `yaml:"servers"`
+}
+
+// Storage represents a Memcached storage sub system satisfying
+// storage.Backend.
+type Storage struct {
+	cl *memcache.Client
+}
+
+// New returns a new Memcached storage instance.
+func New(cfg *Config) *Storage {
+	return &Storage{cl: memcache.New(cfg.Servers...)}
+}
+
+// InsertOrUpdate stores entity under key, replacing any previous value,
+// and records key in every one of its prefixes' companion sets so
+// DeletePrefix/FetchAll keep working despite Memcached having no native
+// prefix iteration, however many colon-delimited segments the caller's
+// prefix ends up truncating at.
+func (s *Storage) InsertOrUpdate(entity interface{}, key []byte) error {
+	gs, ok := entity.(model.GobSerializer)
+	if !ok {
+		return fmt.Errorf("%v: %T", errMemcachedWrongEntityType, entity)
+	}
+	var buf bytes.Buffer
+	gs.ToGob(gob.NewEncoder(&buf))
+
+	if err := s.cl.Set(&memcache.Item{Key: string(key), Value: buf.Bytes()}); err != nil {
+		return err
+	}
+	return s.addToPrefixSet(key)
+}
+
+// Fetch loads the entity stored under key into entity.
+func (s *Storage) Fetch(entity interface{}, key []byte) error {
+	it, err := s.cl.Get(string(key))
+	switch err {
+	case nil:
+		break
+	case memcache.ErrCacheMiss:
+		return storage.ErrNotFound
+	default:
+		return err
+	}
+	if entity == nil {
+		return nil
+	}
+	gd, ok := entity.(model.GobDeserializer)
+	if !ok {
+		return fmt.Errorf("%v: %T", errMemcachedWrongEntityType, entity)
+	}
+	gd.FromGob(gob.NewDecoder(bytes.NewReader(it.Value)))
+	return nil
+}
+
+// FetchAll loads every entity whose key has the given prefix into v.
+func (s *Storage) FetchAll(v interface{}, prefix []byte) error {
+	t := reflect.TypeOf(v).Elem()
+	if t.Kind() != reflect.Slice {
+		return fmt.Errorf("%v: %T", errMemcachedWrongEntityType, v)
+	}
+	keys, err := s.prefixSet(prefix)
+	if err != nil {
+		return err
+	}
+	sl := reflect.ValueOf(v).Elem()
+	for _, key := range keys {
+		it, err := s.cl.Get(key)
+		switch err {
+		case nil:
+			break
+		case memcache.ErrCacheMiss:
+			continue
+		default:
+			return err
+		}
+		e := reflect.New(t.Elem()).Elem()
+		i := e.Addr().Interface()
+		gd, ok := i.(model.GobDeserializer)
+		if !ok {
+			return fmt.Errorf("%v: %T", errMemcachedWrongEntityType, i)
+		}
+		gd.FromGob(gob.NewDecoder(bytes.NewReader(it.Value)))
+		sl.Set(reflect.Append(sl, e))
+	}
+	return nil
+}
+
+// Delete removes the entity stored under key, if any.
+func (s *Storage) Delete(key []byte) error {
+	if err := s.cl.Delete(string(key)); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return s.removeFromPrefixSet(key)
+}
+
+// DeletePrefix removes every entity whose key has the given prefix.
+func (s *Storage) DeletePrefix(prefix []byte) error {
+	keys, err := s.prefixSet(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return s.cl.Delete(prefixSetKey(prefix))
+}
+
+// ForEachKey invokes f for every key with the given prefix.
+func (s *Storage) ForEachKey(prefix []byte, f func(key []byte) error) error {
+	keys, err := s.prefixSet(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := f([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown releases any resource held by the backend.
+func (s *Storage) Shutdown() error {
+	return nil
+}
+
+// prefixSetKey derives the companion key that tracks every key written
+// under prefix, since Memcached has no native prefix iteration.
+func prefixSetKey(prefix []byte) string {
+	return "prefixset:" + string(prefix)
+}
+
+func (s *Storage) prefixSet(prefix []byte) ([]string, error) {
+	it, err := s.cl.Get(prefixSetKey(prefix))
+	switch err {
+	case nil:
+		break
+	case memcache.ErrCacheMiss:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	if len(it.Value) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(it.Value), "\n"), nil
+}
+
+func (s *Storage) addToPrefixSet(key []byte) error {
+	for _, prefix := range storage.KeyPrefixes(key) {
+		if err := s.mutatePrefixSet(prefix, func(keys []string) []string {
+			for _, k := range keys {
+				if k == string(key) {
+					return keys
+				}
+			}
+			return append(keys, string(key))
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) removeFromPrefixSet(key []byte) error {
+	for _, prefix := range storage.KeyPrefixes(key) {
+		if err := s.mutatePrefixSet(prefix, func(keys []string) []string {
+			filtered := keys[:0]
+			for _, k := range keys {
+				if k != string(key) {
+					filtered = append(filtered, k)
+				}
+			}
+			return filtered
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutatePrefixSet applies mutate to the key membership set stored under
+// prefix, retrying on conflict so two concurrent writers touching the
+// same prefix's set never clobber one another's update: CompareAndSwap
+// fails with ErrCASConflict if the set changed since our Get, and Add
+// fails with ErrNotStored if another writer created it first, and either
+// case simply re-reads and retries rather than blindly overwriting.
+func (s *Storage) mutatePrefixSet(prefix []byte, mutate func([]string) []string) error {
+	setKey := prefixSetKey(prefix)
+	for {
+		it, err := s.cl.Get(setKey)
+		switch err {
+		case nil:
+			var keys []string
+			if len(it.Value) > 0 {
+				keys = strings.Split(string(it.Value), "\n")
+			}
+			it.Value = []byte(strings.Join(mutate(keys), "\n"))
+			switch err := s.cl.CompareAndSwap(it); err {
+			case nil:
+				return nil
+			case memcache.ErrCASConflict, memcache.ErrNotStored:
+				continue
+			default:
+				return err
+			}
+		case memcache.ErrCacheMiss:
+			item := &memcache.Item{Key: setKey, Value: []byte(strings.Join(mutate(nil), "\n"))}
+			switch err := s.cl.Add(item); err {
+			case nil:
+				return nil
+			case memcache.ErrNotStored:
+				continue
+			default:
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,21 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package memcached
+
+import (
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/ortuman/jackal/storage/storagetest"
+)
+
+func TestStorage_Conformance(t *testing.T) {
+	s := New(&Config{Servers: []string{"127.0.0.1:11211"}})
+	if _, err := s.cl.Get("conformance:reachability-check"); err != nil && err != memcache.ErrCacheMiss {
+		t.Skipf("no memcached server reachable at 127.0.0.1:11211: %v", err)
+	}
+	storagetest.Run(t, s)
+}
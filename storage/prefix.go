@@ -0,0 +1,24 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+// KeyPrefixes returns every colon-terminated prefix of key, from the
+// first segment up to the last colon; the full key is included only if
+// it ends in a colon. jackal keys are colon
+// delimited (e.g. "offlineMessages:<user>:<id>:<timestamp>"), and a
+// FetchAll/DeletePrefix call can truncate at any one of those colons —
+// not just the last — so a backend that can't scan by prefix natively
+// must track key membership under every one of them, not just the
+// single prefix guessed by truncating at the last colon.
+func KeyPrefixes(key []byte) [][]byte {
+	var prefixes [][]byte
+	for i, b := range key {
+		if b == ':' {
+			prefixes = append(prefixes, key[:i+1])
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,20 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package redis
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage/storagetest"
+)
+
+func TestStorage_Conformance(t *testing.T) {
+	s := New(&Config{Addr: "127.0.0.1:6379"})
+	if err := s.cl.Ping().Err(); err != nil {
+		t.Skipf("no redis server reachable at 127.0.0.1:6379: %v", err)
+	}
+	storagetest.Run(t, s)
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package storage defines the generic key/value contract every jackal
+// storage sub system must satisfy, independent of which engine backs it.
+package storage
+
+import "errors"
+
+// ErrNotFound is returned by Backend.Fetch when no entity is stored
+// under the requested key.
+var ErrNotFound = errors.New("storage: entity not found")
+
+// Backend captures the operations a jackal storage sub system must
+// expose, regardless of whether it is backed by BadgerDB, Memcached or
+// Redis. It is the common surface every concrete backend — and the
+// conformance tests that exercise them — are written against.
+type Backend interface {
+	// InsertOrUpdate stores entity under key, replacing any previous
+	// value.
+	InsertOrUpdate(entity interface{}, key []byte) error
+
+	// Fetch loads the entity stored under key into entity. It returns
+	// ErrNotFound if key does not exist.
+	Fetch(entity interface{}, key []byte) error
+
+	// FetchAll loads every entity whose key has the given prefix into
+	// the slice pointed to by v.
+	FetchAll(v interface{}, prefix []byte) error
+
+	// Delete removes the entity stored under key, if any.
+	Delete(key []byte) error
+
+	// DeletePrefix removes every entity whose key has the given prefix.
+	DeletePrefix(prefix []byte) error
+
+	// ForEachKey invokes f for every key with the given prefix.
+	ForEachKey(prefix []byte, f func(key []byte) error) error
+
+	// Shutdown releases any resource held by the backend.
+	Shutdown() error
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package storagetest provides a conformance suite that exercises the
+// storage.Backend contract identically against any concrete backend, so
+// BadgerDB, Memcached and Redis are all proven to behave the same way
+// rather than trusting that their independent implementations agree.
+package storagetest
+
+import (
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+)
+
+// item is the entity Run stores and fetches; it implements the
+// model.GobSerializer/GobDeserializer contract every storage.Backend
+// entity must satisfy.
+type item struct {
+	ID    string
+	Value string
+}
+
+func (i *item) ToGob(enc *gob.Encoder) {
+	enc.Encode(i.ID)
+	enc.Encode(i.Value)
+}
+
+func (i *item) FromGob(dec *gob.Decoder) {
+	dec.Decode(&i.ID)
+	dec.Decode(&i.Value)
+}
+
+// Run exercises InsertOrUpdate/Fetch/FetchAll/Delete/DeletePrefix/
+// ForEachKey against backend as independent sub-tests. Every key it
+// writes is namespaced under "conformance:" and cleaned up afterwards,
+// so Run is safe to point at a shared, long-lived server.
+func Run(t *testing.T, backend storage.Backend) {
+	t.Run("FetchMissReturnsErrNotFound", func(t *testing.T) { testFetchMiss(t, backend) })
+	t.Run("InsertOrUpdateThenFetchRoundTrips", func(t *testing.T) { testInsertFetch(t, backend) })
+	t.Run("DeleteRemovesEntity", func(t *testing.T) { testDelete(t, backend) })
+	t.Run("FetchAllReturnsEveryEntityUnderPrefix", func(t *testing.T) { testFetchAll(t, backend) })
+	t.Run("DeletePrefixClearsAncestorPrefixesToo", func(t *testing.T) { testDeletePrefix(t, backend) })
+	t.Run("ForEachKeyVisitsEveryKeyUnderPrefix", func(t *testing.T) { testForEachKey(t, backend) })
+}
+
+func testFetchMiss(t *testing.T, backend storage.Backend) {
+	var got item
+	if err := backend.Fetch(&got, []byte("conformance:missing")); err != storage.ErrNotFound {
+		t.Fatalf("Fetch() on a missing key = %v, want storage.ErrNotFound", err)
+	}
+}
+
+func testInsertFetch(t *testing.T, backend storage.Backend) {
+	key := []byte("conformance:insert-fetch")
+	defer backend.Delete(key)
+
+	want := &item{ID: "1", Value: "hello"}
+	if err := backend.InsertOrUpdate(want, key); err != nil {
+		t.Fatalf("InsertOrUpdate() = %v", err)
+	}
+	var got item
+	if err := backend.Fetch(&got, key); err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	if got != *want {
+		t.Fatalf("Fetch() = %+v, want %+v", got, *want)
+	}
+
+	want.Value = "updated"
+	if err := backend.InsertOrUpdate(want, key); err != nil {
+		t.Fatalf("InsertOrUpdate() (update) = %v", err)
+	}
+	if err := backend.Fetch(&got, key); err != nil {
+		t.Fatalf("Fetch() after update = %v", err)
+	}
+	if got != *want {
+		t.Fatalf("Fetch() after update = %+v, want %+v", got, *want)
+	}
+}
+
+func testDelete(t *testing.T, backend storage.Backend) {
+	key := []byte("conformance:delete")
+	if err := backend.InsertOrUpdate(&item{ID: "1"}, key); err != nil {
+		t.Fatalf("InsertOrUpdate() = %v", err)
+	}
+	if err := backend.Delete(key); err != nil {
+		t.Fatalf("Delete() = %v", err)
+	}
+	var got item
+	if err := backend.Fetch(&got, key); err != storage.ErrNotFound {
+		t.Fatalf("Fetch() after Delete() = %v, want storage.ErrNotFound", err)
+	}
+	if err := backend.Delete(key); err != nil {
+		t.Fatalf("Delete() on an already-deleted key = %v, want nil", err)
+	}
+}
+
+func testFetchAll(t *testing.T, backend storage.Backend) {
+	prefix := []byte("conformance:fetchall:")
+	keys := namespacedKeys(prefix, "a", "b")
+	for i, k := range keys {
+		if err := backend.InsertOrUpdate(&item{ID: string(k), Value: fmt.Sprint(i)}, k); err != nil {
+			t.Fatalf("InsertOrUpdate() = %v", err)
+		}
+	}
+	defer deleteAll(backend, keys)
+
+	var got []item
+	if err := backend.FetchAll(&got, prefix); err != nil {
+		t.Fatalf("FetchAll() = %v", err)
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("FetchAll() returned %d entities, want %d", len(got), len(keys))
+	}
+}
+
+// testDeletePrefix guards against exactly the bug a truncate-at-last-
+// colon prefix guess (or a DeletePrefix that bulk-deletes instead of
+// routing through Delete) reintroduces: removing a deeper prefix must
+// also clear the key from every shallower, ancestor prefix's bookkeeping,
+// or a FetchAll/ForEachKey on that ancestor keeps yielding a ghost key
+// that no longer exists.
+func testDeletePrefix(t *testing.T, backend storage.Backend) {
+	outer := []byte("conformance:deleteprefix:")
+	inner := append(append([]byte{}, outer...), []byte("user1:")...)
+	key := append(append([]byte{}, inner...), 'a')
+
+	if err := backend.InsertOrUpdate(&item{ID: "1"}, key); err != nil {
+		t.Fatalf("InsertOrUpdate() = %v", err)
+	}
+	if err := backend.DeletePrefix(inner); err != nil {
+		t.Fatalf("DeletePrefix() = %v", err)
+	}
+
+	var got []item
+	if err := backend.FetchAll(&got, outer); err != nil {
+		t.Fatalf("FetchAll() on ancestor prefix = %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("FetchAll() on ancestor prefix after DeletePrefix() returned %d ghost entities, want 0", len(got))
+	}
+}
+
+func testForEachKey(t *testing.T, backend storage.Backend) {
+	prefix := []byte("conformance:foreach:")
+	keys := namespacedKeys(prefix, "a", "b")
+	for _, k := range keys {
+		if err := backend.InsertOrUpdate(&item{ID: string(k)}, k); err != nil {
+			t.Fatalf("InsertOrUpdate() = %v", err)
+		}
+	}
+	defer deleteAll(backend, keys)
+
+	var visited []string
+	if err := backend.ForEachKey(prefix, func(k []byte) error {
+		visited = append(visited, string(k))
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachKey() = %v", err)
+	}
+	want := make([]string, len(keys))
+	for i, k := range keys {
+		want[i] = string(k)
+	}
+	sort.Strings(visited)
+	sort.Strings(want)
+	if !reflect.DeepEqual(visited, want) {
+		t.Fatalf("ForEachKey() visited = %v, want %v", visited, want)
+	}
+}
+
+func namespacedKeys(prefix []byte, suffixes ...string) [][]byte {
+	keys := make([][]byte, len(suffixes))
+	for i, suffix := range suffixes {
+		keys[i] = append(append([]byte{}, prefix...), []byte(suffix)...)
+	}
+	return keys
+}
+
+func deleteAll(backend storage.Backend, keys [][]byte) {
+	for _, k := range keys {
+		backend.Delete(k)
+	}
+}
@@ -6,6 +6,10 @@
 package xml
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -25,6 +29,9 @@ var ErrStreamClosedByPeer = errors.New("stream closed by peer")
 
 // Parser parses arbitrary XML input and builds an array with the structure of all tag and data elements.
 type Parser struct {
+	reader        io.Reader
+	bufReader     *bufio.Reader
+	compReader    *limitedDecompressReader
 	dec           *xml.Decoder
 	nextElement   *Element
 	parsingIndex  int
@@ -35,14 +42,101 @@ type Parser struct {
 }
 
 // NewParser creates an empty Parser instance.
+//
+// reader is wrapped in a bufio.Reader up front, and dec is built on top
+// of that instead of on reader directly, so dec never allocates its own
+// internal buffering: encoding/xml.NewDecoder only wraps a reader that
+// doesn't already implement io.ByteReader. That keeps every byte read
+// from the wire visible to bufReader, which EnableCompression relies on
+// to recover bytes already buffered ahead of a mid-stream switch to a
+// compressed transport.
 func NewParser(reader io.Reader, maxStanzaSize int) *Parser {
+	bufReader := bufio.NewReader(reader)
 	return &Parser{
-		dec:           xml.NewDecoder(reader),
+		reader:        reader,
+		bufReader:     bufReader,
+		dec:           xml.NewDecoder(bufReader),
 		parsingIndex:  rootElementIndex,
 		maxStanzaSize: int64(maxStanzaSize),
 	}
 }
 
+// EnableCompression switches the parser's underlying reader to a
+// compressed transport per XEP-0138, wrapping it in a flate or zlib
+// reader matching the negotiated method and rebuilding the internal XML
+// decoder. parsingStack and parsingIndex are preserved so a stanza that
+// was partially read before the switch is not lost, and lastOffset is
+// rebased onto the new decoder's offsets (which start again at zero) so
+// the bytes of that partial stanza still count toward maxStanzaSize.
+//
+// bufReader may already hold bytes pulled off reader ahead of the
+// compression ack being tokenized — the start of the compressed stream
+// itself, in the common case where the peer's first compressed bytes
+// arrive in the same read as the handshake. Those are drained out and
+// prepended to reader before building the decompressor, so none of them
+// are lost. The decompressed reader is wrapped with an explicit
+// per-stanza byte cap so a hostile peer cannot smuggle an oversized
+// stanza past maxStanzaSize via a compression bomb; ErrTooLargeStanza
+// accounting keeps working off uncompressed byte offsets either way.
+func (p *Parser) EnableCompression(method string) error {
+	buffered, err := p.bufReader.Peek(p.bufReader.Buffered())
+	if err != nil {
+		return err
+	}
+	leftover := append([]byte{}, buffered...)
+	src := io.MultiReader(bytes.NewReader(leftover), p.reader)
+
+	var zr io.Reader
+	switch method {
+	case "zlib":
+		r, err := zlib.NewReader(src)
+		if err != nil {
+			return err
+		}
+		zr = r
+	case "deflate":
+		zr = flate.NewReader(src)
+	default:
+		return fmt.Errorf("xml: unsupported compression method %q", method)
+	}
+	p.compReader = newLimitedDecompressReader(zr, p.maxStanzaSize)
+	p.lastOffset -= p.dec.InputOffset()
+	p.reader = p.compReader
+	p.bufReader = bufio.NewReader(p.reader)
+	p.dec = xml.NewDecoder(p.bufReader)
+	return nil
+}
+
+// limitedDecompressReader caps the number of decompressed bytes handed
+// out since the last stanza boundary, so a compression bomb cannot
+// exhaust memory before the regular maxStanzaSize offset check runs.
+type limitedDecompressReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newLimitedDecompressReader(r io.Reader, limit int64) *limitedDecompressReader {
+	return &limitedDecompressReader{r: r, limit: limit}
+}
+
+func (l *limitedDecompressReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.read += int64(n)
+		if l.limit > 0 && l.read > l.limit {
+			return n, ErrTooLargeStanza
+		}
+	}
+	return n, err
+}
+
+// resetLimit is called whenever a full stanza has been parsed, so the
+// cap applies per-stanza rather than for the whole compressed stream.
+func (l *limitedDecompressReader) resetLimit() {
+	l.read = 0
+}
+
 // ParseElement parses next available XML element from reader.
 func (p *Parser) ParseElement() (XElement, error) {
 	t, err := p.dec.RawToken()
@@ -88,6 +182,9 @@ func (p *Parser) ParseElement() (XElement, error) {
 	}
 done:
 	p.lastOffset = p.dec.InputOffset()
+	if p.compReader != nil {
+		p.compReader.resetLimit()
+	}
 	ret := p.nextElement
 	p.nextElement = nil
 	return ret, nil
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Serializer writes XML elements out to an underlying writer, mirroring
+// Parser on the read side of the stream.
+type Serializer struct {
+	writer     io.Writer
+	compWriter io.WriteCloser
+}
+
+// NewSerializer creates a Serializer that writes to writer.
+func NewSerializer(writer io.Writer) *Serializer {
+	return &Serializer{writer: writer}
+}
+
+// SerializeElement writes element out, optionally including its closing tag.
+func (s *Serializer) SerializeElement(element XElement, includeClosing bool) error {
+	return element.ToXML(s.writer, includeClosing)
+}
+
+// EnableCompression switches the serializer's underlying writer to a
+// compressed transport per XEP-0138, wrapping it in a flate or zlib
+// writer matching the method negotiated on the read side.
+func (s *Serializer) EnableCompression(method string) error {
+	if s.compWriter != nil {
+		if err := s.compWriter.Close(); err != nil {
+			return err
+		}
+	}
+	switch method {
+	case "zlib":
+		s.compWriter = zlib.NewWriter(s.writer)
+	case "deflate":
+		fw, err := flate.NewWriter(s.writer, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		s.compWriter = fw
+	default:
+		return fmt.Errorf("xml: unsupported compression method %q", method)
+	}
+	s.writer = s.compWriter
+	return nil
+}
+
+// Flush flushes any buffered compressed data so it reaches the peer.
+func (s *Serializer) Flush() error {
+	if f, ok := s.compWriter.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}